@@ -0,0 +1,173 @@
+// Package api exposes the contents of stakingratestats over HTTP so that
+// charting frontends and other downstream consumers can read historical
+// staking rates without speaking Postgres (or SQLite, or Badger) directly.
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/mua69/gstakepool/log"
+)
+
+// RatePoint is one sample (or, for range queries, one downsampled bucket)
+// of the staking rate series. Min/Max/Avg summarize ActualRate over the
+// bucket (RangeSeries) or window (AvgWindow); for Latest, and for a bucket
+// holding a single block, all three equal ActualRate.
+type RatePoint struct {
+	BlockNr       int     `json:"block_nr"`
+	BlockTime     int64   `json:"block_time"`
+	NominalRate   float64 `json:"nominal_rate"`
+	ActualRate    float64 `json:"actual_rate"`
+	MinActualRate float64 `json:"min_actual_rate"`
+	MaxActualRate float64 `json:"max_actual_rate"`
+	AvgActualRate float64 `json:"avg_actual_rate"`
+}
+
+// Store is the read side of stakingratestats needed to serve the query API.
+// It is satisfied by stakingstatd's StatsStore, which implements the
+// aggregation in SQL for the Postgres and SQLite backends and in Go for
+// the Badger backend.
+type Store interface {
+	// RangeSeries downsamples [from,to] into buckets of step blocks.
+	RangeSeries(from, to, step int) ([]RatePoint, error)
+	// Latest returns the most recent stakingratestats entry.
+	Latest() (*RatePoint, bool)
+	// AvgWindow aggregates the most recent window blocks.
+	AvgWindow(window int) (*RatePoint, error)
+}
+
+func intParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("api: failed to encode JSON response: %v", err)
+	}
+}
+
+func writeCsv(w http.ResponseWriter, points []RatePoint) {
+	w.Header().Set("Content-Type", "text/csv")
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"block_nr", "block_time", "nominal_rate", "actual_rate", "min_actual_rate", "max_actual_rate", "avg_actual_rate"})
+	for _, p := range points {
+		cw.Write([]string{
+			strconv.Itoa(p.BlockNr),
+			strconv.FormatInt(p.BlockTime, 10),
+			strconv.FormatFloat(p.NominalRate, 'f', -1, 64),
+			strconv.FormatFloat(p.ActualRate, 'f', -1, 64),
+			strconv.FormatFloat(p.MinActualRate, 'f', -1, 64),
+			strconv.FormatFloat(p.MaxActualRate, 'f', -1, 64),
+			strconv.FormatFloat(p.AvgActualRate, 'f', -1, 64),
+		})
+	}
+	cw.Flush()
+}
+
+func handleRates(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, err := intParam(r, "from", 0)
+		if err != nil {
+			http.Error(w, "invalid 'from' parameter", http.StatusBadRequest)
+			return
+		}
+		to, err := intParam(r, "to", 0)
+		if err != nil {
+			http.Error(w, "invalid 'to' parameter", http.StatusBadRequest)
+			return
+		}
+		step, err := intParam(r, "step", 1)
+		if err != nil || step <= 0 {
+			http.Error(w, "invalid 'step' parameter", http.StatusBadRequest)
+			return
+		}
+		if to < from {
+			http.Error(w, "'to' must not be less than 'from'", http.StatusBadRequest)
+			return
+		}
+
+		points, err := store.RangeSeries(from, to, step)
+		if err != nil {
+			log.Error("api: range query failed: %v", err)
+			http.Error(w, "query failed", http.StatusInternalServerError)
+			return
+		}
+
+		if r.URL.Query().Get("format") == "csv" {
+			writeCsv(w, points)
+			return
+		}
+
+		writeJson(w, points)
+	}
+}
+
+func handleLatest(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, found := store.Latest()
+		if !found {
+			http.Error(w, "no data", http.StatusNotFound)
+			return
+		}
+
+		writeJson(w, p)
+	}
+}
+
+func handleAvg(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		window, err := intParam(r, "window", 1000)
+		if err != nil || window <= 0 {
+			http.Error(w, "invalid 'window' parameter", http.StatusBadRequest)
+			return
+		}
+
+		p, err := store.AvgWindow(window)
+		if err != nil {
+			log.Error("api: avg query failed: %v", err)
+			http.Error(w, "query failed", http.StatusInternalServerError)
+			return
+		}
+		if p == nil {
+			http.Error(w, "no data", http.StatusNotFound)
+			return
+		}
+
+		writeJson(w, p)
+	}
+}
+
+// NewMux builds the HTTP handlers for the query API, separate from
+// StartServer so callers can mount it alongside other handlers (e.g. the
+// metrics server) instead of listening on its own port.
+func NewMux(store Store) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rates", handleRates(store))
+	mux.HandleFunc("/rates/latest", handleLatest(store))
+	mux.HandleFunc("/rates/avg", handleAvg(store))
+	return mux
+}
+
+// StartServer listens on endpoint, serving the query API in a background
+// goroutine, matching the style of stakingstatd's metrics server.
+func StartServer(endpoint string, store Store) {
+	mux := NewMux(store)
+
+	log.Info(0, "Starting query API server on %s", endpoint)
+
+	go func() {
+		err := http.ListenAndServe(endpoint, mux)
+		if err != nil {
+			log.Error("Query API server failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/mua69/gstakepool/log"
+	"github.com/mua69/particlrpc"
+)
+
+const (
+	zmqInitialBackoff = 1 * time.Second
+	zmqMaxBackoff     = 60 * time.Second
+	backfillWorkers   = 4
+)
+
+var gLastSeq = make(map[byte]uint64)
+var gLastSeqMu sync.Mutex
+
+// parseSequenceMsg decodes the particld "sequence" ZMQ topic payload: a
+// 32 byte hash followed by a one byte label. Block connect/disconnect
+// labels ('C'/'D') carry no trailing counter (33 bytes total); mempool
+// add/remove labels ('A'/'R') are followed by an 8 byte little endian
+// sequence number (41 bytes total). seq is only meaningful for 'A'/'R'.
+func parseSequenceMsg(body []byte) (label byte, seq uint64, ok bool) {
+	if len(body) < 32+1 {
+		log.Error("sequence: message too short (%d bytes)", len(body))
+		return 0, 0, false
+	}
+
+	label = body[32]
+
+	switch label {
+	case 'C', 'D':
+		if len(body) != 32+1 {
+			log.Error("sequence: unexpected length %d for block label '%c'", len(body), label)
+			return 0, 0, false
+		}
+		return label, 0, true
+
+	case 'A', 'R':
+		if len(body) != 32+1+8 {
+			log.Error("sequence: unexpected length %d for mempool label '%c'", len(body), label)
+			return 0, 0, false
+		}
+		return label, binary.LittleEndian.Uint64(body[33:41]), true
+
+	default:
+		log.Error("sequence: unknown label '%c' (%d bytes)", label, len(body))
+		return 0, 0, false
+	}
+}
+
+// checkSequenceGap records the sequence number for a label and reports
+// whether it is non-contiguous with the previously seen one.
+func checkSequenceGap(label byte, seq uint64) bool {
+	gLastSeqMu.Lock()
+	defer gLastSeqMu.Unlock()
+
+	last, known := gLastSeq[label]
+	gLastSeq[label] = seq
+
+	return known && seq != last+1
+}
+
+// backfillRange rebuilds stakingratestats for [from, to] using a bounded
+// worker pool so it cannot stall live hashblock processing. getstakinginfo
+// takes no height argument and only ever reflects the node's current tip,
+// so there is no RPC that can recover the nominal/actual rate that
+// actually applied at a historical height; rows are filled in with the
+// rate columns zeroed out rather than mislabeled with today's rate.
+func backfillRange(rpc *particlrpc.ParticlRpc, from, to int) {
+	if from > to {
+		return
+	}
+
+	log.Info(0, "backfill: catching up blocks %d to %d", from, to)
+
+	sem := make(chan struct{}, backfillWorkers)
+	var wg sync.WaitGroup
+
+	for h := from; h <= to; h++ {
+		height := h
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			hash, err := getBlockHashAtHeight(rpc, height)
+			if err != nil {
+				log.Error("backfill: getblockhash(%d) failed: %v", height, err)
+				return
+			}
+
+			blockheader := getBlockHeader(rpc, hash)
+			if blockheader == nil {
+				return
+			}
+
+			ent := newEntry(height, blockheader.Time, 0, 0, hash)
+			gDb.Insert(ent)
+			if gDb2 != nil {
+				gDb2.Insert(ent)
+			}
+		}()
+	}
+
+	wg.Wait()
+	log.Info(0, "backfill: caught up to block %d", to)
+}
+
+// backfillIfNeeded compares the chain tip to the last recorded block and
+// kicks off an asynchronous backfill for anything missing. It is safe to
+// call on every reconnect or detected sequence gap since it is a no-op
+// once the table is current.
+func backfillIfNeeded(rpc *particlrpc.ParticlRpc) {
+	var tip int64
+
+	err := rpc.CallRpc("getblockcount", gConfig.ParticldStakingWallet, nil, &tip)
+	if err != nil {
+		log.Error("backfill: getblockcount failed: %v", err)
+		return
+	}
+
+	last, ok := gDb.LastBlockNr()
+	if !ok {
+		// Nothing recorded yet; nothing to backfill from.
+		return
+	}
+
+	if int(tip) > last {
+		go backfillRange(rpc, last+1, int(tip))
+	}
+}
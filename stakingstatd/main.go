@@ -1,56 +1,80 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
-	_ "github.com/lib/pq"
 	"github.com/mua69/gstakepool/log"
+	"github.com/mua69/gstakepool/stakingstatd/api"
 	"github.com/mua69/particlrpc"
 	"github.com/pebbe/zmq4"
 	"io/ioutil"
 	"os"
 	"time"
-	)
+)
 
-type Config struct {
-	ParticldRpcPort       int    `json:"particld_rpc_port"`
-	ParticldRpcHost       string `json:"particld_rpc_host"`
-	ParticldDataDir       string `json:"particld_data_dir"`
-	ParticldStakingWallet string `json:"particld_staking_wallet"`
-	ZmqEndpoint           string `json:"zmq_endpoint"`
-	DbUrl                 string `json:"db_url"`
-	DbUrl2                string `json:"db_url_2"`
-	LogFile               string `json:"log_file"`
+type PeerConfig struct {
+	Id    string `json:"id"`
+	DbUrl string `json:"db_url"`
 }
 
-type TableDef struct {
-	name string
-	cols string
+type Config struct {
+	ParticldRpcPort       int          `json:"particld_rpc_port"`
+	ParticldRpcHost       string       `json:"particld_rpc_host"`
+	ParticldDataDir       string       `json:"particld_data_dir"`
+	ParticldStakingWallet string       `json:"particld_staking_wallet"`
+	ZmqEndpoint           string       `json:"zmq_endpoint"`
+	DbUrl                 string       `json:"db_url"`
+	DbUrl2                string       `json:"db_url_2"`
+	LogFile               string       `json:"log_file"`
+	MetricsEndpoint       string       `json:"metrics_endpoint"`
+	ApiEndpoint           string       `json:"api_endpoint"`
+	StorageBackend        string       `json:"storage_backend"`
+	NodeId                string       `json:"node_id"`
+	Peers                 []PeerConfig `json:"peers"`
 }
 
 const SatPerPart = 100000000
 
 type TableEntry struct {
-	BlockNr int
-	BlockTime int64
+	BlockNr     int
+	BlockTime   int64
 	NominalRate float64
-	ActualRate float64
+	ActualRate  float64
+	BlockHash   []byte
+	SourceId    string
+	UpdatedAt   int64
 }
 
 type TableEntryMap map[int]*TableEntry
 
-var gTableDef = []TableDef{{"stakingratestats", "block_nr int PRIMARY KEY, block_time bigint, nominal_rate numeric, actual_rate numeric"}}
-
 var gConfig Config
 var gInitDb bool
 var gClearDb bool
 var gDbSelect int
 var gDbSync int
+var gReindexFrom int
+var gSyncDaemon bool
+var gSyncRange int
+var gSyncIntervalSec int
 var gAvgActualReward = float64(0)
-var gDb *sql.DB
-var gDb2 *sql.DB
+var gDb StatsStore
+var gDb2 StatsStore
+var gRpc *particlrpc.ParticlRpc
+
+// newEntry stamps a TableEntry with this node's identity and the current
+// time so CRDT merges across peers can resolve conflicting writes.
+func newEntry(blocknr int, blocktime int64, nominalRate, actualRate float64, blockHash []byte) *TableEntry {
+	return &TableEntry{
+		BlockNr:     blocknr,
+		BlockTime:   blocktime,
+		NominalRate: nominalRate,
+		ActualRate:  actualRate,
+		BlockHash:   blockHash,
+		SourceId:    gConfig.NodeId,
+		UpdatedAt:   time.Now().Unix(),
+	}
+}
 
 func usage() {
 	log.Error("Usage: stakingstatd <config.json>")
@@ -63,10 +87,14 @@ func parseCommandLine() {
 	flag.BoolVar(&gClearDb, "cleardb", false, "clears database and exit")
 	flag.IntVar(&gDbSelect, "db", 1, "select db (1 or 2) for initdb/cleardb")
 	flag.IntVar(&gDbSync, "syncdb", 0, "synchronize last n entries of 2 dbs")
+	flag.IntVar(&gReindexFrom, "reindex", 0, "rebuild stakingratestats starting at given block height and exit")
+	flag.BoolVar(&gSyncDaemon, "syncdaemon", false, "continuously merge stakingratestats with configured peers")
+	flag.IntVar(&gSyncRange, "syncrange", 1000, "number of most recent entries considered per sync round")
+	flag.IntVar(&gSyncIntervalSec, "syncinterval", 60, "seconds between sync rounds in -syncdaemon mode")
 	flag.Parse()
 }
 
-func selectDb() *sql.DB {
+func selectDb() StatsStore {
 	switch gDbSelect {
 	case 1:
 		return gDb
@@ -101,99 +129,21 @@ func readConfig(filename string) bool {
 	return true
 }
 
-func dbConnect(url string) *sql.DB {
-	db, err := sql.Open("postgres", url)
-
-	if err != nil {
-		log.Error("Cannot connect to data base: %v", err)
-		return nil
-	}
-
-	err = db.Ping()
-
-	if err != nil {
-		log.Error("Cannot connect to data base: %v", err)
-		return nil
-	}
-
-	return db
-}
-
-func dbInit(db *sql.DB) bool {
-	for _, d := range gTableDef {
-		_, err := db.Exec("create table " + d.name + " (" + d.cols + ");")
-
-		if err != nil {
-			log.Error("DB: failed to create table '%s': %v", d.name, err)
-			return false
-		}
-	}
-
-	return true
-}
-
-func dbClear(db *sql.DB) bool {
-	for _, d := range gTableDef {
-		_, err := db.Exec("drop table " + d.name + ";")
-
-		if err != nil {
-			log.Error("DB: failed to delete table '%s': %v", d.name, err)
-			return false
-		}
-	}
-
-	return true
-}
-
-func dbUpdate(db *sql.DB, blocknr int, blocktime int64, nominalRate, actualRate float64) {
-
-	_, err := db.Exec("INSERT INTO stakingratestats (block_nr, block_time, nominal_rate, actual_rate) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
-		blocknr, blocktime, nominalRate, actualRate)
-	if err != nil {
-		log.Error("Inserting into db failed: %v", err)
-	}
-
-}
-
-func dbUpdateEnt(db *sql.DB, ent *TableEntry) {
-	dbUpdate(db, ent.BlockNr, ent.BlockTime, ent.NominalRate, ent.ActualRate)
-}
-
-func getTableEntries(db *sql.DB, n int) TableEntryMap {
-
-	mdata := make(TableEntryMap, n)
-
-	rows, err := db.Query("SELECT block_nr,block_time,nominal_rate,actual_rate FROM stakingratestats ORDER BY block_nr DESC LIMIT $1", n)
-
-	if err == nil {
-		for cont := rows.Next(); cont; cont = rows.Next() {
-			var ent TableEntry
-
-			err = rows.Scan(&ent.BlockNr, &ent.BlockTime, &ent.NominalRate, &ent.ActualRate)
-
-			if err == nil {
-				mdata[ent.BlockNr] = &ent
-			} else {
-				log.Error("db scan failed: %v\n", err)
-			}
+// computeReward derives the nominal and actual staking reward from the
+// node's current stake info for the live collector. The reindex and
+// backfill code paths do not use it; they store zeroed rates instead.
+func computeReward(stakeinfo *particlrpc.StakingInfo) (nominalReward, actualReward float64) {
+	nominalReward = stakeinfo.Percentyearreward * (100 - stakeinfo.Treasurydonationpercent) / 100
 
-		}
-		err = rows.Err()
-		if err != nil {
-			log.Error("db next row failed: %v\n", err)
-		}
-		err = rows.Close()
-		if err != nil {
-			log.Error("db close rows failed: %v\n", err)
-		}
-	} else {
-		log.Error("db query failed: %v\n", err)
-	}
+	actualReward = stakeinfo.Moneysupply * stakeinfo.Percentyearreward * (100 - stakeinfo.Treasurydonationpercent)
+	actualReward /= 100 * 100
+	actualReward /= float64(stakeinfo.Netstakeweight) / SatPerPart
+	actualReward *= 100
 
-	return mdata
+	return nominalReward, actualReward
 }
 
-func calcStakingReward(stakeinfo *particlrpc.StakingInfo, blockheader *particlrpc.Block) {
+func calcStakingReward(stakeinfo *particlrpc.StakingInfo, blockheader *particlrpc.Block, blockHash []byte) {
 	/*
 		var blockReward float64
 
@@ -206,12 +156,7 @@ func calcStakingReward(stakeinfo *particlrpc.StakingInfo, blockheader *particlrp
 		actualReward := blockReward / stakingTime * 365 * 100 / float64(stakeinfo.Weight) * SatPerPart
 	*/
 
-	nominalReward := stakeinfo.Percentyearreward * (100 - stakeinfo.Treasurydonationpercent) / 100
-
-	actualReward := stakeinfo.Moneysupply * stakeinfo.Percentyearreward * (100 - stakeinfo.Treasurydonationpercent)
-	actualReward /= 100 * 100
-	actualReward /= float64(stakeinfo.Netstakeweight) / SatPerPart
-	actualReward *= 100
+	nominalReward, actualReward := computeReward(stakeinfo)
 
 	if gAvgActualReward != 0 {
 		gAvgActualReward = 0.99*gAvgActualReward + 0.01*actualReward
@@ -220,10 +165,13 @@ func calcStakingReward(stakeinfo *particlrpc.StakingInfo, blockheader *particlrp
 	}
 
 	log.Info(0, "Actual avg reward: %.8f", gAvgActualReward)
-	dbUpdate(gDb, blockheader.Height, blockheader.Time, nominalReward, actualReward)
+	ent := newEntry(blockheader.Height, blockheader.Time, nominalReward, actualReward, blockHash)
+	gDb.Insert(ent)
 	if gDb2 != nil {
-		dbUpdate(gDb2, blockheader.Height, blockheader.Time, nominalReward, actualReward)
+		gDb2.Insert(ent)
 	}
+
+	metricsRecordReward(nominalReward, actualReward, gAvgActualReward, float64(stakeinfo.Netstakeweight), stakeinfo.Moneysupply, blockheader.Height, blockheader.Time)
 }
 
 func getStakingInfo(rpc *particlrpc.ParticlRpc) *particlrpc.StakingInfo {
@@ -276,41 +224,81 @@ func collectStakingStats(rpc *particlrpc.ParticlRpc) {
 	}
 
 	zmq.SetSubscribe("hashblock")
+	zmq.SetSubscribe("sequence")
+
+	backfillIfNeeded(rpc)
+
+	backoff := zmqInitialBackoff
 
 	for {
 		msg, err := zmq.RecvMessageBytes(0)
 		if err != nil {
 			log.Error("zmq receive failed: %v\n", err)
-			time.Sleep(10 * time.Second)
-		} else {
+			metricsIncZmqReconnects()
+			time.Sleep(backoff)
+			if backoff < zmqMaxBackoff {
+				backoff *= 2
+				if backoff > zmqMaxBackoff {
+					backoff = zmqMaxBackoff
+				}
+			}
+			backfillIfNeeded(rpc)
+			continue
+		}
+
+		backoff = zmqInitialBackoff
+
+		switch string(msg[0]) {
+		case "hashblock":
 			log.Info(0, "stakingRewardCollector: Processing block: %s\n", hex.EncodeToString(msg[1]))
 
 			blockheader := getBlockHeader(rpc, msg[1])
 			stakeinfo := getStakingInfo(rpc)
 
 			if blockheader != nil && stakeinfo != nil {
-				calcStakingReward(stakeinfo, blockheader)
+				checkReorg(gDb, rpc, blockheader.Height)
+				if gDb2 != nil {
+					checkReorg(gDb2, rpc, blockheader.Height)
+				}
+
+				calcStakingReward(stakeinfo, blockheader, msg[1])
 			}
-		}
-	}
 
-}
+		case "sequence":
+			label, seq, ok := parseSequenceMsg(msg[1])
+			if !ok {
+				continue
+			}
 
-func syncTableWork(mdata1 TableEntryMap, mdata2 TableEntryMap, db2 *sql.DB, ident string) {
-	for block, ent := range mdata1 {
-		if mdata2[block] == nil {
-			log.Info(0, "Transferring entry for block %d: %s", block, ident)
-			dbUpdateEnt(db2, ent)
+			switch label {
+			case 'C', 'D':
+				// Block connect/disconnect events carry no sequence counter;
+				// treat every one as a trigger to check for missed blocks.
+				backfillIfNeeded(rpc)
+			default:
+				if checkSequenceGap(label, seq) {
+					log.Info(0, "stakingRewardCollector: sequence gap detected on topic '%c', backfilling\n", label)
+					backfillIfNeeded(rpc)
+				}
+			}
 		}
 	}
+
 }
 
-func syncTables(n int) {
-	mdata1 := getTableEntries(gDb, n)
-	mdata2 := getTableEntries(gDb2, n)
+func newRpc() *particlrpc.ParticlRpc {
+	rpc := particlrpc.NewParticlRpc()
+	rpc.SetDataDirectoy(gConfig.ParticldDataDir)
+	rpc.SetRpcHost(gConfig.ParticldRpcHost)
+	rpc.SetRpcPort(gConfig.ParticldRpcPort)
 
-	syncTableWork(mdata1, mdata2, gDb2, "db1->db2")
-	syncTableWork(mdata2, mdata1, gDb, "db2->db1")
+	err := rpc.ReadPartRpcCookie()
+	if err != nil {
+		log.Error("%v", err)
+		os.Exit(1)
+	}
+
+	return rpc
 }
 
 func main() {
@@ -329,21 +317,23 @@ func main() {
 		defer log.CloseLogFile()
 	}
 
-	gDb = dbConnect(gConfig.DbUrl)
-	if gDb == nil {
-		log.Fatal("Failed to connect to database `%s`.", gConfig.DbUrl)
+	var err error
+
+	gDb, err = newStatsStore(gConfig.DbUrl)
+	if err != nil {
+		log.Fatal("Failed to open database `%s`: %v", gConfig.DbUrl, err)
 	}
 
 	if gConfig.DbUrl2 != "" {
-		gDb2 = dbConnect(gConfig.DbUrl2)
-		if gDb2 == nil {
-			log.Fatal("Failed to connect to database `%s`.", gConfig.DbUrl2)
+		gDb2, err = newStatsStore(gConfig.DbUrl2)
+		if err != nil {
+			log.Fatal("Failed to open database `%s`: %v", gConfig.DbUrl2, err)
 		}
 	}
 
 	if gInitDb {
 		db := selectDb()
-		if dbInit(db) {
+		if db.Init() {
 			return
 		} else {
 			log.Fatal("Failed to initialize database.")
@@ -352,7 +342,7 @@ func main() {
 
 	if gClearDb {
 		db := selectDb()
-		if dbClear(db) {
+		if db.Clear() {
 			return
 		} else {
 			log.Fatal("Failed to clear database.")
@@ -367,15 +357,34 @@ func main() {
 		return
 	}
 
-	rpc := particlrpc.NewParticlRpc()
-	rpc.SetDataDirectoy(gConfig.ParticldDataDir)
-	rpc.SetRpcHost(gConfig.ParticldRpcHost)
-	rpc.SetRpcPort(gConfig.ParticldRpcPort)
+	if gSyncDaemon {
+		syncDaemon(gSyncRange, time.Duration(gSyncIntervalSec)*time.Second)
+		return
+	}
 
-	err := rpc.ReadPartRpcCookie()
-	if err != nil {
-		log.Error("%v", err)
-		os.Exit(1)
+	gDb.Migrate()
+	if gDb2 != nil {
+		gDb2.Migrate()
+	}
+
+	rpc := newRpc()
+	gRpc = rpc
+
+	if gReindexFrom > 0 {
+		db := selectDb()
+		if reindexFromHeight(db, rpc, gReindexFrom) {
+			return
+		} else {
+			log.Fatal("Failed to reindex database.")
+		}
+	}
+
+	if gConfig.MetricsEndpoint != "" {
+		startMetricsServer(gConfig.MetricsEndpoint)
+	}
+
+	if gConfig.ApiEndpoint != "" {
+		api.StartServer(gConfig.ApiEndpoint, gDb)
 	}
 
 	log.Info(0, "Starting staking stats collector")
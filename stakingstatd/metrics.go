@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mua69/gstakepool/log"
+)
+
+// gMetrics holds the latest values exposed on the /metrics endpoint. Reward
+// and supply figures and the block cursor are updated from
+// calcStakingReward, the reconnect counter from collectStakingStats and the
+// insert failure counter from the StatsStore Insert, Upsert and MarkStale
+// implementations.
+type Metrics struct {
+	mu sync.RWMutex
+
+	nominalReward    float64
+	actualReward     float64
+	avgActualReward  float64
+	netStakeWeight   float64
+	moneySupply      float64
+	lastBlockHeight  int64
+	lastBlockTime    int64
+	zmqReconnects    int64
+	dbInsertFailures int64
+}
+
+var gMetrics Metrics
+
+func metricsRecordReward(nominalReward, actualReward, avgActualReward, netStakeWeight, moneySupply float64, blockHeight int, blockTime int64) {
+	gMetrics.mu.Lock()
+	defer gMetrics.mu.Unlock()
+
+	gMetrics.nominalReward = nominalReward
+	gMetrics.actualReward = actualReward
+	gMetrics.avgActualReward = avgActualReward
+	gMetrics.netStakeWeight = netStakeWeight
+	gMetrics.moneySupply = moneySupply
+	gMetrics.lastBlockHeight = int64(blockHeight)
+	gMetrics.lastBlockTime = blockTime
+}
+
+func metricsIncZmqReconnects() {
+	atomic.AddInt64(&gMetrics.zmqReconnects, 1)
+}
+
+func metricsIncDbInsertFailures() {
+	atomic.AddInt64(&gMetrics.dbInsertFailures, 1)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	gMetrics.mu.RLock()
+	defer gMetrics.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP gstakepool_nominal_reward Nominal annual staking reward percentage.\n")
+	fmt.Fprintf(w, "# TYPE gstakepool_nominal_reward gauge\n")
+	fmt.Fprintf(w, "gstakepool_nominal_reward %f\n", gMetrics.nominalReward)
+
+	fmt.Fprintf(w, "# HELP gstakepool_actual_reward Actual annual staking reward percentage for the last processed block.\n")
+	fmt.Fprintf(w, "# TYPE gstakepool_actual_reward gauge\n")
+	fmt.Fprintf(w, "gstakepool_actual_reward %f\n", gMetrics.actualReward)
+
+	fmt.Fprintf(w, "# HELP gstakepool_avg_actual_reward Exponentially averaged actual reward percentage.\n")
+	fmt.Fprintf(w, "# TYPE gstakepool_avg_actual_reward gauge\n")
+	fmt.Fprintf(w, "gstakepool_avg_actual_reward %f\n", gMetrics.avgActualReward)
+
+	fmt.Fprintf(w, "# HELP gstakepool_netstakeweight Network stake weight reported by the last getstakinginfo call.\n")
+	fmt.Fprintf(w, "# TYPE gstakepool_netstakeweight gauge\n")
+	fmt.Fprintf(w, "gstakepool_netstakeweight %f\n", gMetrics.netStakeWeight)
+
+	fmt.Fprintf(w, "# HELP gstakepool_moneysupply Money supply reported by the last getstakinginfo call.\n")
+	fmt.Fprintf(w, "# TYPE gstakepool_moneysupply gauge\n")
+	fmt.Fprintf(w, "gstakepool_moneysupply %f\n", gMetrics.moneySupply)
+
+	fmt.Fprintf(w, "# HELP gstakepool_last_block_height Height of the last block processed by the stats collector.\n")
+	fmt.Fprintf(w, "# TYPE gstakepool_last_block_height gauge\n")
+	fmt.Fprintf(w, "gstakepool_last_block_height %d\n", gMetrics.lastBlockHeight)
+
+	fmt.Fprintf(w, "# HELP gstakepool_last_block_time Unix time of the last block processed by the stats collector.\n")
+	fmt.Fprintf(w, "# TYPE gstakepool_last_block_time gauge\n")
+	fmt.Fprintf(w, "gstakepool_last_block_time %d\n", gMetrics.lastBlockTime)
+
+	fmt.Fprintf(w, "# HELP gstakepool_zmq_reconnects_total Number of times the ZMQ subscriber had to reconnect.\n")
+	fmt.Fprintf(w, "# TYPE gstakepool_zmq_reconnects_total counter\n")
+	fmt.Fprintf(w, "gstakepool_zmq_reconnects_total %d\n", atomic.LoadInt64(&gMetrics.zmqReconnects))
+
+	fmt.Fprintf(w, "# HELP gstakepool_db_insert_failures_total Number of failed inserts into stakingratestats.\n")
+	fmt.Fprintf(w, "# TYPE gstakepool_db_insert_failures_total counter\n")
+	fmt.Fprintf(w, "gstakepool_db_insert_failures_total %d\n", atomic.LoadInt64(&gMetrics.dbInsertFailures))
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	healthy := true
+	var body bytes.Buffer
+
+	if err := gDb.Ping(); err != nil {
+		healthy = false
+		fmt.Fprintf(&body, "db: error: %v\n", err)
+	} else {
+		fmt.Fprintf(&body, "db: ok\n")
+	}
+
+	if gDb2 != nil {
+		if err := gDb2.Ping(); err != nil {
+			healthy = false
+			fmt.Fprintf(&body, "db2: error: %v\n", err)
+		} else {
+			fmt.Fprintf(&body, "db2: ok\n")
+		}
+	}
+
+	var blockCount int64
+	if err := gRpc.CallRpc("getblockcount", gConfig.ParticldStakingWallet, nil, &blockCount); err != nil {
+		healthy = false
+		fmt.Fprintf(&body, "rpc: error: %v\n", err)
+	} else {
+		fmt.Fprintf(&body, "rpc: ok\n")
+	}
+
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body.Bytes())
+}
+
+func startMetricsServer(endpoint string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+
+	log.Info(0, "Starting metrics server on %s", endpoint)
+
+	go func() {
+		err := http.ListenAndServe(endpoint, mux)
+		if err != nil {
+			log.Error("Metrics server failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/mua69/gstakepool/log"
+	"github.com/mua69/particlrpc"
+)
+
+// ReorgCheckDepth is the number of recent blocks re-checked against the
+// canonical chain on every hashblock notification.
+const ReorgCheckDepth = 6
+
+func getBlockHashAtHeight(rpc *particlrpc.ParticlRpc, height int) ([]byte, error) {
+	var hashHex string
+
+	args := []interface{}{height}
+	err := rpc.CallRpc("getblockhash", gConfig.ParticldStakingWallet, args, &hashHex)
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(hashHex)
+}
+
+// checkReorg walks back ReorgCheckDepth blocks from tipHeight and compares
+// the canonical block hash against what is stored in store, rewriting any
+// row whose hash has diverged.
+func checkReorg(store StatsStore, rpc *particlrpc.ParticlRpc, tipHeight int) {
+	for h := tipHeight; h > tipHeight-ReorgCheckDepth && h >= 0; h-- {
+		storedHash, ok := store.GetBlockHash(h)
+		if !ok || storedHash == nil {
+			continue
+		}
+
+		canonicalHash, err := getBlockHashAtHeight(rpc, h)
+		if err != nil {
+			log.Error("reorg check: getblockhash(%d) failed: %v", h, err)
+			continue
+		}
+
+		if !bytes.Equal(storedHash, canonicalHash) {
+			log.Info(0, "Reorg detected: block %d changed hash, marking stale", h)
+			store.MarkStale(h, canonicalHash)
+		}
+	}
+}
+
+// reindexFromHeight rebuilds stakingratestats from scratch starting at
+// fromHeight, driven by the -reindex command line flag. getstakinginfo
+// takes no height argument and only ever reflects the node's current
+// tip, so there is no RPC that can recover the nominal/actual rate that
+// actually applied at a historical height. Rather than mislabel today's
+// rate as every backfilled block's rate, rows are rebuilt with the rate
+// columns zeroed out, matching how checkReorg leaves a row it marks stale.
+// The live collector only inserts rows that are not stored yet, so it does
+// not fill these rates back in.
+func reindexFromHeight(store StatsStore, rpc *particlrpc.ParticlRpc, fromHeight int) bool {
+	var tip int64
+
+	err := rpc.CallRpc("getblockcount", gConfig.ParticldStakingWallet, nil, &tip)
+	if err != nil {
+		log.Error("reindex: getblockcount failed: %v", err)
+		return false
+	}
+
+	for h := fromHeight; h <= int(tip); h++ {
+		hash, err := getBlockHashAtHeight(rpc, h)
+		if err != nil {
+			log.Error("reindex: getblockhash(%d) failed: %v", h, err)
+			continue
+		}
+
+		blockheader := getBlockHeader(rpc, hash)
+		if blockheader == nil {
+			continue
+		}
+
+		store.Upsert(newEntry(h, blockheader.Time, 0, 0, hash))
+		log.Info(0, "reindex: rebuilt block %d", h)
+	}
+
+	log.Info(0, "reindex: done, rebuilt blocks %d to %d", fromHeight, tip)
+	return true
+}
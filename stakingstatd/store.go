@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mua69/gstakepool/stakingstatd/api"
+)
+
+// StatsStore abstracts the persistence of stakingratestats so that
+// stakingstatd is not hard-wired to Postgres. Ping, Close, RangeSeries and
+// AvgWindow hand their errors back to the caller; the other methods log
+// their own errors, matching the style of the original *sql.DB based
+// helpers they replace. It embeds api.Store
+// so that any StatsStore can be handed straight to the query API.
+type StatsStore interface {
+	Init() bool
+	Clear() bool
+	Insert(ent *TableEntry) bool
+	Range(n int) TableEntryMap
+	// Upsert unconditionally overwrites a row, used by the CRDT peer merge
+	// to apply the winning entry regardless of what is already stored.
+	Upsert(ent *TableEntry) bool
+	GetBlockHash(blocknr int) ([]byte, bool)
+	MarkStale(blocknr int, blockHash []byte) bool
+	LastBlockNr() (int, bool)
+	Migrate()
+	Ping() error
+	Close() error
+
+	api.Store
+}
+
+// newStatsStore opens a StatsStore for url. The backend is chosen from the
+// URI scheme (sqlite:// or badger://) when present, falling back to
+// gConfig.StorageBackend, and finally to Postgres for backward
+// compatibility with plain DSNs.
+func newStatsStore(url string) (StatsStore, error) {
+	switch {
+	case strings.HasPrefix(url, "sqlite://"):
+		return newSQLiteStore(strings.TrimPrefix(url, "sqlite://"))
+
+	case strings.HasPrefix(url, "badger://"):
+		return newBadgerStore(strings.TrimPrefix(url, "badger://"))
+
+	default:
+		switch gConfig.StorageBackend {
+		case "", "postgres":
+			return newPostgresStore(url)
+		case "sqlite":
+			return newSQLiteStore(url)
+		case "badger":
+			return newBadgerStore(url)
+		default:
+			return nil, fmt.Errorf("unknown storage_backend %q", gConfig.StorageBackend)
+		}
+	}
+}
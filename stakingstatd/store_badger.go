@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/mua69/gstakepool/log"
+	"github.com/mua69/gstakepool/stakingstatd/api"
+)
+
+// BadgerStore is an embedded key-value backend for hobby stakers who do
+// not want to run Postgres or SQLite. Each stakingratestats row is stored
+// as a JSON blob keyed by the big-endian block height, which keeps
+// iteration ordered by block_nr for free.
+type BadgerStore struct {
+	db *badger.DB
+}
+
+func newBadgerStore(path string) (StatsStore, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BadgerStore{db: db}, nil
+}
+
+func blockKey(blocknr int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(blocknr))
+	return key
+}
+
+func (s *BadgerStore) Init() bool {
+	return true
+}
+
+func (s *BadgerStore) Clear() bool {
+	if err := s.db.DropAll(); err != nil {
+		log.Error("DB: failed to clear badger store: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func (s *BadgerStore) Insert(ent *TableEntry) bool {
+	data, err := json.Marshal(ent)
+	if err != nil {
+		log.Error("failed to marshal table entry: %v", err)
+		return false
+	}
+
+	err = s.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(blockKey(ent.BlockNr))
+		if err == nil {
+			return nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		return txn.Set(blockKey(ent.BlockNr), data)
+	})
+
+	if err != nil {
+		log.Error("Inserting into db failed: %v", err)
+		metricsIncDbInsertFailures()
+		return false
+	}
+
+	return true
+}
+
+func (s *BadgerStore) Upsert(ent *TableEntry) bool {
+	data, err := json.Marshal(ent)
+	if err != nil {
+		log.Error("failed to marshal table entry: %v", err)
+		return false
+	}
+
+	err = s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(blockKey(ent.BlockNr), data)
+	})
+
+	if err != nil {
+		log.Error("Upserting into db failed: %v", err)
+		metricsIncDbInsertFailures()
+		return false
+	}
+
+	return true
+}
+
+// get looks up the raw entry for blocknr, used internally by Latest.
+func (s *BadgerStore) get(blocknr int) (*TableEntry, bool) {
+	var ent TableEntry
+	var found bool
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(blockKey(blocknr))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			if err := json.Unmarshal(val, &ent); err != nil {
+				return err
+			}
+			found = true
+			return nil
+		})
+	})
+
+	if err != nil {
+		log.Error("db query for block %d failed: %v", blocknr, err)
+		return nil, false
+	}
+
+	return &ent, found
+}
+
+func (s *BadgerStore) Range(n int) TableEntryMap {
+	mdata := make(TableEntryMap, n)
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		count := 0
+		for it.Rewind(); it.Valid() && count < n; it.Next() {
+			var ent TableEntry
+
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &ent)
+			})
+			if err != nil {
+				log.Error("db scan failed: %v\n", err)
+				continue
+			}
+
+			mdata[ent.BlockNr] = &ent
+			count++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Error("db query failed: %v\n", err)
+	}
+
+	return mdata
+}
+
+func (s *BadgerStore) GetBlockHash(blocknr int) ([]byte, bool) {
+	var hash []byte
+	var found bool
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(blockKey(blocknr))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			var ent TableEntry
+			if err := json.Unmarshal(val, &ent); err != nil {
+				return err
+			}
+			hash = ent.BlockHash
+			found = true
+			return nil
+		})
+	})
+
+	if err != nil {
+		log.Error("db query for block hash of block %d failed: %v", blocknr, err)
+		return nil, false
+	}
+
+	return hash, found
+}
+
+func (s *BadgerStore) MarkStale(blocknr int, blockHash []byte) bool {
+	err := s.db.Update(func(txn *badger.Txn) error {
+		var ent TableEntry
+
+		item, err := txn.Get(blockKey(blocknr))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err == nil {
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &ent)
+			}); err != nil {
+				return err
+			}
+		}
+
+		ent.BlockNr = blocknr
+		ent.BlockHash = blockHash
+		ent.NominalRate = 0
+		ent.ActualRate = 0
+		ent.SourceId = gConfig.NodeId
+		ent.UpdatedAt = time.Now().Unix()
+
+		data, err := json.Marshal(&ent)
+		if err != nil {
+			return err
+		}
+
+		return txn.Set(blockKey(blocknr), data)
+	})
+
+	if err != nil {
+		log.Error("marking reorged block %d stale failed: %v", blocknr, err)
+		metricsIncDbInsertFailures()
+		return false
+	}
+
+	return true
+}
+
+func (s *BadgerStore) LastBlockNr() (int, bool) {
+	var last int
+	var found bool
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		it.Rewind()
+		if it.Valid() {
+			last = int(binary.BigEndian.Uint64(it.Item().Key()))
+			found = true
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Error("querying last block_nr failed: %v", err)
+		return 0, false
+	}
+
+	return last, found
+}
+
+// RangeSeries has no query engine to push the aggregation down to, so it
+// is computed here in Go while iterating the key range.
+func (s *BadgerStore) RangeSeries(from, to, step int) ([]api.RatePoint, error) {
+	if step <= 0 {
+		step = 1
+	}
+
+	type acc struct {
+		p     api.RatePoint
+		sum   float64
+		count int
+	}
+	buckets := make(map[int]*acc)
+	var order []int
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(blockKey(from)); it.Valid(); it.Next() {
+			var ent TableEntry
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &ent)
+			})
+			if err != nil {
+				return err
+			}
+			if ent.BlockNr > to {
+				break
+			}
+
+			bucket := (ent.BlockNr - from) / step
+			a, ok := buckets[bucket]
+			if !ok {
+				a = &acc{p: api.RatePoint{BlockNr: ent.BlockNr, MinActualRate: ent.ActualRate, MaxActualRate: ent.ActualRate}}
+				buckets[bucket] = a
+				order = append(order, bucket)
+			}
+			if ent.BlockTime > a.p.BlockTime {
+				a.p.BlockTime = ent.BlockTime
+			}
+			if ent.ActualRate < a.p.MinActualRate {
+				a.p.MinActualRate = ent.ActualRate
+			}
+			if ent.ActualRate > a.p.MaxActualRate {
+				a.p.MaxActualRate = ent.ActualRate
+			}
+			a.p.NominalRate += ent.NominalRate
+			a.sum += ent.ActualRate
+			a.count++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]api.RatePoint, 0, len(order))
+	for _, bucket := range order {
+		a := buckets[bucket]
+		a.p.NominalRate /= float64(a.count)
+		a.p.AvgActualRate = a.sum / float64(a.count)
+		a.p.ActualRate = a.p.AvgActualRate
+		points = append(points, a.p)
+	}
+
+	return points, nil
+}
+
+func (s *BadgerStore) Latest() (*api.RatePoint, bool) {
+	blocknr, found := s.LastBlockNr()
+	if !found {
+		return nil, false
+	}
+
+	ent, found := s.get(blocknr)
+	if !found {
+		return nil, false
+	}
+
+	return &api.RatePoint{
+		BlockNr: ent.BlockNr, BlockTime: ent.BlockTime,
+		NominalRate: ent.NominalRate, ActualRate: ent.ActualRate,
+		MinActualRate: ent.ActualRate, MaxActualRate: ent.ActualRate, AvgActualRate: ent.ActualRate,
+	}, true
+}
+
+// AvgWindow aggregates by reverse iteration since there is no SQL engine
+// to push the aggregation down to.
+func (s *BadgerStore) AvgWindow(window int) (*api.RatePoint, error) {
+	var p api.RatePoint
+	var sum float64
+	var count int
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid() && count < window; it.Next() {
+			var ent TableEntry
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &ent)
+			})
+			if err != nil {
+				return err
+			}
+
+			if count == 0 {
+				p.BlockNr = ent.BlockNr
+				p.BlockTime = ent.BlockTime
+				p.MinActualRate = ent.ActualRate
+				p.MaxActualRate = ent.ActualRate
+			}
+			if ent.ActualRate < p.MinActualRate {
+				p.MinActualRate = ent.ActualRate
+			}
+			if ent.ActualRate > p.MaxActualRate {
+				p.MaxActualRate = ent.ActualRate
+			}
+			p.NominalRate += ent.NominalRate
+			sum += ent.ActualRate
+			count++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	p.NominalRate /= float64(count)
+	p.AvgActualRate = sum / float64(count)
+	p.ActualRate = p.AvgActualRate
+
+	return &p, nil
+}
+
+// Migrate is a no-op: entries are schemaless JSON, so older records
+// simply decode with a zero-value BlockHash.
+func (s *BadgerStore) Migrate() {
+}
+
+func (s *BadgerStore) Ping() error {
+	return nil
+}
+
+func (s *BadgerStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/mua69/gstakepool/log"
+	"github.com/mua69/gstakepool/stakingstatd/api"
+)
+
+type TableDef struct {
+	name string
+	cols string
+}
+
+var gTableDef = []TableDef{{"stakingratestats", "block_nr int PRIMARY KEY, block_time bigint, nominal_rate numeric, actual_rate numeric, block_hash bytea, source_id text, updated_at bigint"}}
+
+// PostgresStore is the original, production backend.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func newPostgresStore(url string) (StatsStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) Init() bool {
+	for _, d := range gTableDef {
+		_, err := s.db.Exec("create table " + d.name + " (" + d.cols + ");")
+
+		if err != nil {
+			log.Error("DB: failed to create table '%s': %v", d.name, err)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *PostgresStore) Clear() bool {
+	for _, d := range gTableDef {
+		_, err := s.db.Exec("drop table " + d.name + ";")
+
+		if err != nil {
+			log.Error("DB: failed to delete table '%s': %v", d.name, err)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *PostgresStore) Insert(ent *TableEntry) bool {
+	_, err := s.db.Exec("INSERT INTO stakingratestats (block_nr, block_time, nominal_rate, actual_rate, block_hash, source_id, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING",
+		ent.BlockNr, ent.BlockTime, ent.NominalRate, ent.ActualRate, ent.BlockHash, ent.SourceId, ent.UpdatedAt)
+	if err != nil {
+		log.Error("Inserting into db failed: %v", err)
+		metricsIncDbInsertFailures()
+		return false
+	}
+
+	return true
+}
+
+func (s *PostgresStore) Upsert(ent *TableEntry) bool {
+	_, err := s.db.Exec(`INSERT INTO stakingratestats (block_nr, block_time, nominal_rate, actual_rate, block_hash, source_id, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (block_nr) DO UPDATE SET block_time = $2, nominal_rate = $3, actual_rate = $4, block_hash = $5, source_id = $6, updated_at = $7`,
+		ent.BlockNr, ent.BlockTime, ent.NominalRate, ent.ActualRate, ent.BlockHash, ent.SourceId, ent.UpdatedAt)
+	if err != nil {
+		log.Error("Upserting into db failed: %v", err)
+		metricsIncDbInsertFailures()
+		return false
+	}
+
+	return true
+}
+
+func (s *PostgresStore) Range(n int) TableEntryMap {
+	mdata := make(TableEntryMap, n)
+
+	rows, err := s.db.Query("SELECT block_nr,block_time,nominal_rate,actual_rate,block_hash,source_id,updated_at FROM stakingratestats ORDER BY block_nr DESC LIMIT $1", n)
+
+	if err == nil {
+		for cont := rows.Next(); cont; cont = rows.Next() {
+			var ent TableEntry
+
+			err = rows.Scan(&ent.BlockNr, &ent.BlockTime, &ent.NominalRate, &ent.ActualRate, &ent.BlockHash, &ent.SourceId, &ent.UpdatedAt)
+
+			if err == nil {
+				mdata[ent.BlockNr] = &ent
+			} else {
+				log.Error("db scan failed: %v\n", err)
+			}
+
+		}
+		err = rows.Err()
+		if err != nil {
+			log.Error("db next row failed: %v\n", err)
+		}
+		err = rows.Close()
+		if err != nil {
+			log.Error("db close rows failed: %v\n", err)
+		}
+	} else {
+		log.Error("db query failed: %v\n", err)
+	}
+
+	return mdata
+}
+
+func (s *PostgresStore) GetBlockHash(blocknr int) ([]byte, bool) {
+	var hash []byte
+
+	err := s.db.QueryRow("SELECT block_hash FROM stakingratestats WHERE block_nr = $1", blocknr).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return nil, false
+	}
+	if err != nil {
+		log.Error("db query for block hash of block %d failed: %v", blocknr, err)
+		return nil, false
+	}
+
+	return hash, true
+}
+
+func (s *PostgresStore) MarkStale(blocknr int, blockHash []byte) bool {
+	_, err := s.db.Exec("UPDATE stakingratestats SET block_hash = $2, nominal_rate = 0, actual_rate = 0, source_id = $3, updated_at = $4 WHERE block_nr = $1",
+		blocknr, blockHash, gConfig.NodeId, time.Now().Unix())
+	if err != nil {
+		log.Error("marking reorged block %d stale failed: %v", blocknr, err)
+		metricsIncDbInsertFailures()
+		return false
+	}
+
+	return true
+}
+
+func (s *PostgresStore) LastBlockNr() (int, bool) {
+	var max sql.NullInt64
+
+	err := s.db.QueryRow("SELECT MAX(block_nr) FROM stakingratestats").Scan(&max)
+	if err != nil {
+		log.Error("querying last block_nr failed: %v", err)
+		return 0, false
+	}
+	if !max.Valid {
+		return 0, false
+	}
+
+	return int(max.Int64), true
+}
+
+func (s *PostgresStore) RangeSeries(from, to, step int) ([]api.RatePoint, error) {
+	if step <= 0 {
+		step = 1
+	}
+
+	rows, err := s.db.Query(`SELECT (block_nr - $1) / $3 AS bucket, min(block_nr), max(block_time),
+			avg(nominal_rate), min(actual_rate), max(actual_rate), avg(actual_rate)
+		FROM stakingratestats WHERE block_nr BETWEEN $1 AND $2 GROUP BY bucket ORDER BY bucket`, from, to, step)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []api.RatePoint
+	for rows.Next() {
+		var bucket int
+		var p api.RatePoint
+
+		if err := rows.Scan(&bucket, &p.BlockNr, &p.BlockTime, &p.NominalRate, &p.MinActualRate, &p.MaxActualRate, &p.AvgActualRate); err != nil {
+			return nil, err
+		}
+		p.ActualRate = p.AvgActualRate
+		points = append(points, p)
+	}
+
+	return points, rows.Err()
+}
+
+func (s *PostgresStore) Latest() (*api.RatePoint, bool) {
+	var p api.RatePoint
+
+	err := s.db.QueryRow("SELECT block_nr, block_time, nominal_rate, actual_rate FROM stakingratestats ORDER BY block_nr DESC LIMIT 1").
+		Scan(&p.BlockNr, &p.BlockTime, &p.NominalRate, &p.ActualRate)
+	if err == sql.ErrNoRows {
+		return nil, false
+	}
+	if err != nil {
+		log.Error("db query for latest entry failed: %v", err)
+		return nil, false
+	}
+	p.MinActualRate, p.MaxActualRate, p.AvgActualRate = p.ActualRate, p.ActualRate, p.ActualRate
+
+	return &p, true
+}
+
+func (s *PostgresStore) AvgWindow(window int) (*api.RatePoint, error) {
+	var p api.RatePoint
+	var count int
+
+	err := s.db.QueryRow(`SELECT count(*), coalesce(max(block_nr), 0), coalesce(max(block_time), 0), coalesce(avg(nominal_rate), 0),
+			coalesce(min(actual_rate), 0), coalesce(max(actual_rate), 0), coalesce(avg(actual_rate), 0)
+		FROM (SELECT * FROM stakingratestats ORDER BY block_nr DESC LIMIT $1) recent`, window).
+		Scan(&count, &p.BlockNr, &p.BlockTime, &p.NominalRate, &p.MinActualRate, &p.MaxActualRate, &p.AvgActualRate)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	p.ActualRate = p.AvgActualRate
+
+	return &p, nil
+}
+
+// Migrate upgrades a stakingratestats table created before the
+// block_hash, source_id and updated_at columns were introduced.
+func (s *PostgresStore) Migrate() {
+	stmts := []string{
+		"ALTER TABLE stakingratestats ADD COLUMN IF NOT EXISTS block_hash bytea",
+		"ALTER TABLE stakingratestats ADD COLUMN IF NOT EXISTS source_id text",
+		"ALTER TABLE stakingratestats ADD COLUMN IF NOT EXISTS updated_at bigint",
+	}
+
+	for _, stmt := range stmts {
+		if _, err := s.db.Exec(stmt); err != nil {
+			log.Error("DB: failed to migrate stakingratestats (%s): %v", stmt, err)
+		}
+	}
+}
+
+func (s *PostgresStore) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
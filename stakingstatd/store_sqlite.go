@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mua69/gstakepool/log"
+	"github.com/mua69/gstakepool/stakingstatd/api"
+)
+
+// SQLiteStore lets a single-node operator run stakingstatd without
+// standing up Postgres. It targets the same stakingratestats schema,
+// translated to SQLite's dialect.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (StatsStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Init() bool {
+	_, err := s.db.Exec("create table stakingratestats (block_nr int PRIMARY KEY, block_time bigint, nominal_rate real, actual_rate real, block_hash blob, source_id text, updated_at bigint)")
+
+	if err != nil {
+		log.Error("DB: failed to create table 'stakingratestats': %v", err)
+		return false
+	}
+
+	return true
+}
+
+func (s *SQLiteStore) Clear() bool {
+	_, err := s.db.Exec("drop table stakingratestats")
+
+	if err != nil {
+		log.Error("DB: failed to delete table 'stakingratestats': %v", err)
+		return false
+	}
+
+	return true
+}
+
+func (s *SQLiteStore) Insert(ent *TableEntry) bool {
+	_, err := s.db.Exec("INSERT INTO stakingratestats (block_nr, block_time, nominal_rate, actual_rate, block_hash, source_id, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		ent.BlockNr, ent.BlockTime, ent.NominalRate, ent.ActualRate, ent.BlockHash, ent.SourceId, ent.UpdatedAt)
+	if err != nil {
+		log.Error("Inserting into db failed: %v", err)
+		metricsIncDbInsertFailures()
+		return false
+	}
+
+	return true
+}
+
+func (s *SQLiteStore) Upsert(ent *TableEntry) bool {
+	_, err := s.db.Exec(`INSERT INTO stakingratestats (block_nr, block_time, nominal_rate, actual_rate, block_hash, source_id, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (block_nr) DO UPDATE SET block_time = excluded.block_time, nominal_rate = excluded.nominal_rate,
+			actual_rate = excluded.actual_rate, block_hash = excluded.block_hash, source_id = excluded.source_id, updated_at = excluded.updated_at`,
+		ent.BlockNr, ent.BlockTime, ent.NominalRate, ent.ActualRate, ent.BlockHash, ent.SourceId, ent.UpdatedAt)
+	if err != nil {
+		log.Error("Upserting into db failed: %v", err)
+		metricsIncDbInsertFailures()
+		return false
+	}
+
+	return true
+}
+
+func (s *SQLiteStore) Range(n int) TableEntryMap {
+	mdata := make(TableEntryMap, n)
+
+	rows, err := s.db.Query("SELECT block_nr,block_time,nominal_rate,actual_rate,block_hash,source_id,updated_at FROM stakingratestats ORDER BY block_nr DESC LIMIT ?", n)
+
+	if err == nil {
+		for cont := rows.Next(); cont; cont = rows.Next() {
+			var ent TableEntry
+
+			err = rows.Scan(&ent.BlockNr, &ent.BlockTime, &ent.NominalRate, &ent.ActualRate, &ent.BlockHash, &ent.SourceId, &ent.UpdatedAt)
+
+			if err == nil {
+				mdata[ent.BlockNr] = &ent
+			} else {
+				log.Error("db scan failed: %v\n", err)
+			}
+
+		}
+		err = rows.Err()
+		if err != nil {
+			log.Error("db next row failed: %v\n", err)
+		}
+		err = rows.Close()
+		if err != nil {
+			log.Error("db close rows failed: %v\n", err)
+		}
+	} else {
+		log.Error("db query failed: %v\n", err)
+	}
+
+	return mdata
+}
+
+func (s *SQLiteStore) GetBlockHash(blocknr int) ([]byte, bool) {
+	var hash []byte
+
+	err := s.db.QueryRow("SELECT block_hash FROM stakingratestats WHERE block_nr = ?", blocknr).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return nil, false
+	}
+	if err != nil {
+		log.Error("db query for block hash of block %d failed: %v", blocknr, err)
+		return nil, false
+	}
+
+	return hash, true
+}
+
+func (s *SQLiteStore) MarkStale(blocknr int, blockHash []byte) bool {
+	_, err := s.db.Exec("UPDATE stakingratestats SET block_hash = ?, nominal_rate = 0, actual_rate = 0, source_id = ?, updated_at = ? WHERE block_nr = ?",
+		blockHash, gConfig.NodeId, time.Now().Unix(), blocknr)
+	if err != nil {
+		log.Error("marking reorged block %d stale failed: %v", blocknr, err)
+		metricsIncDbInsertFailures()
+		return false
+	}
+
+	return true
+}
+
+func (s *SQLiteStore) LastBlockNr() (int, bool) {
+	var max sql.NullInt64
+
+	err := s.db.QueryRow("SELECT MAX(block_nr) FROM stakingratestats").Scan(&max)
+	if err != nil {
+		log.Error("querying last block_nr failed: %v", err)
+		return 0, false
+	}
+	if !max.Valid {
+		return 0, false
+	}
+
+	return int(max.Int64), true
+}
+
+func (s *SQLiteStore) RangeSeries(from, to, step int) ([]api.RatePoint, error) {
+	if step <= 0 {
+		step = 1
+	}
+
+	rows, err := s.db.Query(`SELECT (block_nr - ?) / ? AS bucket, min(block_nr), max(block_time),
+			avg(nominal_rate), min(actual_rate), max(actual_rate), avg(actual_rate)
+		FROM stakingratestats WHERE block_nr BETWEEN ? AND ? GROUP BY bucket ORDER BY bucket`, from, step, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []api.RatePoint
+	for rows.Next() {
+		var bucket int
+		var p api.RatePoint
+
+		if err := rows.Scan(&bucket, &p.BlockNr, &p.BlockTime, &p.NominalRate, &p.MinActualRate, &p.MaxActualRate, &p.AvgActualRate); err != nil {
+			return nil, err
+		}
+		p.ActualRate = p.AvgActualRate
+		points = append(points, p)
+	}
+
+	return points, rows.Err()
+}
+
+func (s *SQLiteStore) Latest() (*api.RatePoint, bool) {
+	var p api.RatePoint
+
+	err := s.db.QueryRow("SELECT block_nr, block_time, nominal_rate, actual_rate FROM stakingratestats ORDER BY block_nr DESC LIMIT 1").
+		Scan(&p.BlockNr, &p.BlockTime, &p.NominalRate, &p.ActualRate)
+	if err == sql.ErrNoRows {
+		return nil, false
+	}
+	if err != nil {
+		log.Error("db query for latest entry failed: %v", err)
+		return nil, false
+	}
+	p.MinActualRate, p.MaxActualRate, p.AvgActualRate = p.ActualRate, p.ActualRate, p.ActualRate
+
+	return &p, true
+}
+
+func (s *SQLiteStore) AvgWindow(window int) (*api.RatePoint, error) {
+	var p api.RatePoint
+	var count int
+
+	err := s.db.QueryRow(`SELECT count(*), coalesce(max(block_nr), 0), coalesce(max(block_time), 0), coalesce(avg(nominal_rate), 0),
+			coalesce(min(actual_rate), 0), coalesce(max(actual_rate), 0), coalesce(avg(actual_rate), 0)
+		FROM (SELECT * FROM stakingratestats ORDER BY block_nr DESC LIMIT ?) recent`, window).
+		Scan(&count, &p.BlockNr, &p.BlockTime, &p.NominalRate, &p.MinActualRate, &p.MaxActualRate, &p.AvgActualRate)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	p.ActualRate = p.AvgActualRate
+
+	return &p, nil
+}
+
+// Migrate adds columns to a table created before they existed. SQLite
+// lacks "ADD COLUMN IF NOT EXISTS", so the column list is checked via
+// PRAGMA table_info first.
+func (s *SQLiteStore) Migrate() {
+	wanted := map[string]string{
+		"block_hash": "blob",
+		"source_id":  "text",
+		"updated_at": "bigint",
+	}
+
+	rows, err := s.db.Query("PRAGMA table_info(stakingratestats)")
+	if err != nil {
+		log.Error("DB: failed to inspect stakingratestats: %v", err)
+		return
+	}
+
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notnull, pk int
+		var dflt sql.NullString
+
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			log.Error("DB: failed to read stakingratestats column info: %v", err)
+			rows.Close()
+			return
+		}
+		delete(wanted, name)
+	}
+	rows.Close()
+
+	for name, ctype := range wanted {
+		if _, err := s.db.Exec("ALTER TABLE stakingratestats ADD COLUMN " + name + " " + ctype); err != nil {
+			log.Error("DB: failed to migrate stakingratestats to add %s: %v", name, err)
+		}
+	}
+}
+
+func (s *SQLiteStore) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/mua69/gstakepool/log"
+)
+
+// resolveConflict picks the winning entry for a block that two stores
+// disagree on: the most recently updated entry wins, with a deterministic
+// tie-break on block_hash so that every peer converges on the same
+// winner even if clocks are equal.
+func resolveConflict(a, b *TableEntry) *TableEntry {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+
+	if a.UpdatedAt != b.UpdatedAt {
+		if a.UpdatedAt > b.UpdatedAt {
+			return a
+		}
+		return b
+	}
+
+	if bytes.Compare(a.BlockHash, b.BlockHash) >= 0 {
+		return a
+	}
+	return b
+}
+
+func sameEntry(a, b *TableEntry) bool {
+	return a.NominalRate == b.NominalRate && a.ActualRate == b.ActualRate &&
+		bytes.Equal(a.BlockHash, b.BlockHash) && a.UpdatedAt == b.UpdatedAt && a.SourceId == b.SourceId
+}
+
+// mergeStores compares the n most recent entries of local and peer and
+// applies a last-write-wins-with-tie-break-by-hash merge, writing the
+// winner back to whichever side does not already have it. This makes
+// sync safe to run repeatedly between any pair of peers without a
+// designated primary.
+func mergeStores(local StatsStore, peer StatsStore, localId, peerId string, n int) {
+	localEntries := local.Range(n)
+	peerEntries := peer.Range(n)
+
+	blocks := make(map[int]bool, len(localEntries)+len(peerEntries))
+	for block := range localEntries {
+		blocks[block] = true
+	}
+	for block := range peerEntries {
+		blocks[block] = true
+	}
+
+	for block := range blocks {
+		le := localEntries[block]
+		pe := peerEntries[block]
+
+		winner := resolveConflict(le, pe)
+		if winner == nil {
+			continue
+		}
+
+		if le == nil || !sameEntry(winner, le) {
+			log.Info(0, "sync: applying block %d from %s to %s", block, peerId, localId)
+			local.Upsert(winner)
+		}
+		if pe == nil || !sameEntry(winner, pe) {
+			log.Info(0, "sync: applying block %d from %s to %s", block, localId, peerId)
+			peer.Upsert(winner)
+		}
+	}
+}
+
+// syncTables is the legacy one-shot -syncdb entry point: merge the last n
+// entries between the two statically configured databases.
+func syncTables(n int) {
+	mergeStores(gDb, gDb2, "db1", "db2", n)
+}
+
+// syncDaemon runs mergeStores against every configured peer on a fixed
+// interval, forming an eventually-consistent cluster of stakingstatd
+// instances with no designated primary.
+func syncDaemon(n int, interval time.Duration) {
+	if len(gConfig.Peers) == 0 {
+		log.Fatal("-syncdaemon requires at least one entry in the 'peers' config list.")
+	}
+
+	peerStores := make(map[string]StatsStore, len(gConfig.Peers))
+	for _, peer := range gConfig.Peers {
+		store, err := newStatsStore(peer.DbUrl)
+		if err != nil {
+			log.Fatal("syncdaemon: failed to open peer '%s' (%s): %v", peer.Id, peer.DbUrl, err)
+		}
+		peerStores[peer.Id] = store
+	}
+
+	localId := gConfig.NodeId
+	if localId == "" {
+		localId = "local"
+	}
+
+	for {
+		for _, peer := range gConfig.Peers {
+			mergeStores(gDb, peerStores[peer.Id], localId, peer.Id, n)
+		}
+
+		time.Sleep(interval)
+	}
+}